@@ -2,27 +2,249 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"go/format"
+	"go/scanner"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	homedir "github.com/mitchellh/go-homedir"
 	got "github.com/taskcluster/go-got"
 	"github.com/taskcluster/taskcluster-cli/apis/definitions"
+	"github.com/taskcluster/taskcluster-cli/client"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+var manifestURL = flag.String(
+	"manifest-url", "http://references.taskcluster.net/manifest.json",
+	"location of the API manifest listing all services",
+)
+
+var output = flag.String(
+	"output", "services.go",
+	"file to write the generated source to",
+)
+
+var rootURL = flag.String(
+	"root-url", os.Getenv("TASKCLUSTER_ROOT_URL"),
+	"root URL of the deployment to fetch the manifest from, ignored if -manifest-url is given",
+)
+
+var snapshotDir = flag.String(
+	"snapshot", "",
+	"write the fetched manifest, references and schemas to this directory instead of generating services.go",
+)
+
+var offlineDir = flag.String(
+	"offline", "",
+	"generate services.go from a directory written with -snapshot instead of fetching anything",
+)
+
+var requireHTTPS = flag.Bool(
+	"require-https", false,
+	"fail if the manifest, or any service reference, schema or meta-schema it leads to, is not served over https",
+)
+
+var schemaValidation = flag.String(
+	"schema-validation", "error",
+	"what to do with schemas not valid against the meta-schema they declare: error, warn or off",
+)
+
+var resolveSchemaRefs = flag.Bool(
+	"resolve-refs", false,
+	"inline the targets of $ref in the generated schemas, which must all be part of the manifest",
+)
+
+var typedSchemas = flag.Bool(
+	"typed-schemas", false,
+	"also generate Go types for the input and output schemas of every entry",
+)
+
+var gzipSchemas = flag.Bool(
+	"gzip-schemas", false,
+	"store the schemas gzipped in services.go, to be decompressed on first use",
+)
+
+var dedupSchemas = flag.Bool(
+	"dedup-schemas", false,
+	"store schemas with identical bodies once in services.go, keyed by SHA-256",
+)
+
+var caFile = flag.String(
+	"ca-file", "",
+	"PEM file with additional root certificates to trust, e.g. for a TLS-terminating proxy",
+)
+
+var noKeepAlives = flag.Bool(
+	"no-keep-alives", false,
+	"use a new connection for every request",
+)
+
+var timeout = flag.Duration(
+	"timeout", 30*time.Second,
+	"time limit for each attempt at a request",
+)
+
+var deadline = flag.Duration(
+	"deadline", 10*time.Minute,
+	"time limit for the whole run, including retries, 0 for none; requests in flight are aborted and not retried once it passes",
+)
+
+var retries = flag.Int(
+	"retries", 5,
+	"number of times to retry a request failing with a network error, a 5xx response or exceeding -timeout",
+)
+
+var concurrency = flag.Int(
+	"concurrency", 8,
+	"maximum number of requests in flight",
+)
+
+var cacheDir = flag.String(
+	"cache-dir", defaultCacheDir(),
+	"directory to cache responses in between runs, caching is disabled if empty",
+)
+
+var noCache = flag.Bool(
+	"no-cache", false,
+	"fetch everything again instead of revalidating cached responses, the cache is still updated",
 )
 
 func main() {
-	// synchronization objects
-	mutex := &sync.Mutex{}
-	wg := &sync.WaitGroup{}
+	flag.Parse()
+	if *concurrency < 1 {
+		log.Fatalln("error: -concurrency must be at least 1")
+	}
+	if *offlineDir != "" && *snapshotDir != "" {
+		log.Fatalln("error: -offline and -snapshot cannot be used together")
+	}
+	switch *schemaValidation {
+	case "error", "warn", "off":
+	default:
+		log.Fatalln("error: -schema-validation must be error, warn or off")
+	}
+
+	// An explicit manifest URL takes precedence over the root URL.
+	if *rootURL != "" && !flagSet("manifest-url") {
+		*manifestURL = manifestFromRootURL(*rootURL)
+	}
 
 	// go-got is thread-safe by virtue of only reading from the shared object
 	// and initializing anything within the scope of a function.
+	c, err := newClient(*timeout, *caFile, !*noKeepAlives)
+	if err != nil {
+		log.Fatalln("error: failed to set up http client: ", err)
+	}
+	if *cacheDir != "" && *offlineDir == "" {
+		installCache(c, *cacheDir, !*noCache)
+	}
+	// go-got retries network errors and 5xx responses with exponential
+	// backoff. Responses that fail to parse are never retried.
 	g := got.New()
+	g.Client = c
+	g.Retries = *retries
+	f := &fetcher{
+		got:         g,
+		credentials: credentialsFromEnv(),
+		slots:       make(chan struct{}, *concurrency),
+	}
+	if *snapshotDir != "" {
+		f.snapshot = make(map[string][]byte)
+	}
+
+	// Offline, everything comes from the snapshot, starting with the
+	// manifest it was taken from.
+	var src source = f
+	if *offlineDir != "" {
+		s, err := openSnapshot(*offlineDir)
+		if err != nil {
+			log.Fatalln("error: failed to open snapshot: ", err)
+		}
+		src = s
+		*manifestURL = s.index.Manifest
+	}
+	if u, err := url.Parse(*manifestURL); err == nil {
+		f.signHost = u.Host
+	}
+
+	// Each request is bounded by -timeout, but retries and a server stalling
+	// on every request could still hold up the build indefinitely.
+	ctx := context.Background()
+	if *deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *deadline)
+		defer cancel()
+	}
+
+	opts := options{
+		RequireHTTPS:     *requireHTTPS,
+		SchemaValidation: *schemaValidation,
+		ResolveRefs:      *resolveSchemaRefs,
+		TypedSchemas:     *typedSchemas,
+		GzipSchemas:      *gzipSchemas,
+		DedupSchemas:     *dedupSchemas,
+	}
+
+	// In snapshot mode we only keep the raw documents, so they can be used
+	// for generation later on.
+	if *snapshotDir != "" {
+		if _, err := generateServices(ctx, src, *manifestURL, opts); err != nil {
+			log.Fatalln("error:", err)
+		}
+		if err := writeSnapshot(*snapshotDir, *manifestURL, f.snapshot); err != nil {
+			log.Fatalln("error: failed to write snapshot: ", err)
+		}
+		return
+	}
+
+	if err := generateServicesToFile(ctx, src, *manifestURL, *output, opts); err != nil {
+		log.Fatalln("error:", err)
+	}
+}
+
+// options selects how services.go is generated, the zero value generating it
+// as is from whatever was fetched.
+type options struct {
+	RequireHTTPS     bool   // Fail if a reference or schema is not served over https
+	SchemaValidation string // "error" or "warn" to validate schemas, anything else not to
+	ResolveRefs      bool   // Inline the targets of $ref in schemas
+	TypedSchemas     bool   // Also generate Go types for the schemas
+	GzipSchemas      bool   // Store the schemas gzipped
+	DedupSchemas     bool   // Store identical schema bodies once
+}
+
+// generateServices gets the manifest at manifestURL from src, along with every
+// service reference and schema it refers to, and returns the source of the
+// services.go file of the apis package, generated as opts says. Fetches in
+// flight are abandoned once ctx is done, or as soon as one of them fails.
+func generateServices(ctx context.Context, src source, manifestURL string, opts options) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// synchronization objects
+	mutex := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
 
 	gen := &generator{}
 
@@ -32,31 +254,34 @@ func main() {
 	gen.Print("import \"github.com/taskcluster/taskcluster-cli/apis/definitions\"\n")
 	gen.Print("\n")
 
+	// The manifest decides every other URL, so it must be as trusted as they
+	// are.
+	if opts.RequireHTTPS && !isHTTPS(manifestURL) {
+		return nil, fmt.Errorf("api manifest not served over https: %s", manifestURL)
+	}
+
 	// Fetch API manifest
-	res, err := g.Get("http://references.taskcluster.net/manifest.json").Send()
+	body, err := src.Get(ctx, manifestURL)
 	if err != nil {
-		log.Fatalln("error: failed to fetch api manifest: ", err)
+		return nil, fmt.Errorf("failed to fetch api manifest: %s", err)
 	}
 	// Parse API manifest
 	var manifest map[string]string
-	if err = json.Unmarshal(res.Body, &manifest); err != nil {
-		log.Fatalln("error: failed to parse api manifest: ", err)
+	if err = json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse api manifest: %s", err)
+	}
+	if insecure := insecureReferences(manifest); opts.RequireHTTPS && len(insecure) > 0 {
+		return nil, fmt.Errorf("service references not served over https:\n  %s", strings.Join(insecure, "\n  "))
 	}
 
 	log.Println("Fetching Services:")
-	services := make(map[string]definitions.Service)
-	for name, referenceURL := range manifest {
-		wg.Add(1)
-		go func(n string, u string) {
-			s := fetchService(g, n, u)
-
-			mutex.Lock()
-			services[n] = s
-			mutex.Unlock()
-			wg.Done()
-		}(name, referenceURL)
+	services, err := fetchServices(ctx, src, manifest)
+	if err != nil {
+		return nil, err
+	}
+	if insecure := insecureSchemas(services); opts.RequireHTTPS && len(insecure) > 0 {
+		return nil, fmt.Errorf("schemas not served over https:\n  %s", strings.Join(insecure, "\n  "))
 	}
-	wg.Wait()
 
 	gen.Print("var services = ")
 	gen.PrettyPrint(services)
@@ -67,6 +292,10 @@ func main() {
 	schemas := make(map[string]string, 0)
 	urls := make(map[string]bool, 0)
 
+	// firstErr is the first error met by the goroutines below, they stop the
+	// others by canceling ctx.
+	var firstErr error
+
 	// addSchema is the function that determines if a schema url needs to be
 	// fetched and starts the goroutine to fetch it if needed.
 	addSchema := func(url string) {
@@ -78,9 +307,13 @@ func main() {
 		urls[url] = true
 		wg.Add(1)
 		go func() {
-			s := fetchSchema(g, url)
+			s, err := fetchSchema(ctx, src, url)
 
 			mutex.Lock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+				cancel()
+			}
 			schemas[url] = s
 			mutex.Unlock()
 			wg.Done()
@@ -93,53 +326,1096 @@ func main() {
 		}
 	}
 	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if opts.SchemaValidation == "error" || opts.SchemaValidation == "warn" {
+		invalid, err := invalidSchemas(ctx, src, schemas, opts.RequireHTTPS)
+		if err != nil {
+			return nil, err
+		}
+		if len(invalid) > 0 && opts.SchemaValidation == "error" {
+			return nil, fmt.Errorf("schemas not valid against their meta-schema:\n  %s", strings.Join(invalid, "\n  "))
+		}
+		for _, msg := range invalid {
+			log.Println("warning: invalid schema", msg)
+		}
+	}
+	if opts.ResolveRefs {
+		if schemas, err = resolveRefs(schemas); err != nil {
+			return nil, err
+		}
+	}
 
-	gen.Print("var schemas = ")
-	gen.PrettyPrint(schemas)
-	gen.Print("\n")
+	// With DedupSchemas, the schemas map is keyed by SHA-256 and the
+	// schemaKeys map gives the key of each URL.
+	bodies := schemas
+	if opts.DedupSchemas {
+		var keys map[string]string
+		bodies, keys = dedupByContent(schemas)
+		gen.Print("func init() {\n")
+		gen.Print("schemaKeys = ")
+		gen.PrettyPrint(keys)
+		gen.Print("\n}\n")
+	}
+	if opts.GzipSchemas {
+		compressed, err := compressSchemas(bodies)
+		if err != nil {
+			return nil, err
+		}
+		gen.PrintCompressedSchemas(compressed)
+	} else {
+		gen.Print("var schemas = ")
+		gen.PrettyPrint(bodies)
+		gen.Print("\n")
+	}
+
+	if opts.TypedSchemas {
+		if err := gen.PrintSchemaTypes(services, schemas); err != nil {
+			return nil, err
+		}
+	}
 
 	// Format the output.
-	source, err := gen.Format()
+	code, err := gen.Format()
+	if err != nil {
+		return nil, fmt.Errorf("go fmt, code generation failed: %s", err)
+	}
+	return code, nil
+}
+
+// generateServicesToFile generates services.go as generateServices does, and
+// writes it to outPath, creating its directory if needed. The file is only
+// replaced once generation succeeded, and atomically, so that it is never
+// left partially written.
+func generateServicesToFile(ctx context.Context, src source, manifestURL, outPath string, opts options) error {
+	code, err := generateServices(ctx, src, manifestURL, opts)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(outPath), 0775); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(outPath, code, 0664); err != nil {
+		return fmt.Errorf("failed to save %s: %s", outPath, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path, then renames
+// it to path, so that readers see either the previous content or data. Like
+// ioutil.WriteFile, the file is created with perm less the umask.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := createTemp(path, perm)
 	if err != nil {
-		log.Fatalln("error: go fmt, code generation failed: ", err)
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// createTemp creates a new file, with perm less the umask, next to path and
+// named after it. Unlike ioutil.TempFile, which always uses 0600, the mode is
+// the one the file at path should end up with.
+func createTemp(path string, perm os.FileMode) (*os.File, error) {
+	prefix := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	for i := 0; ; i++ {
+		name := prefix + strconv.Itoa(os.Getpid()) + "-" + strconv.Itoa(i)
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// flagSet returns true if the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// manifestFromRootURL returns the location of the manifest of the deployment
+// with the given root URL.
+func manifestFromRootURL(rootURL string) string {
+	return strings.TrimRight(rootURL, "/") + "/references/manifest.json"
+}
+
+// fetchServices fetches the reference of every service in the manifest.
+// Several services may share the same reference URL, in which case it is only
+// fetched once and the resulting definition is used for each of them. The
+// first failure cancels the remaining fetches and is returned.
+func fetchServices(ctx context.Context, src source, manifest map[string]string) (map[string]definitions.Service, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	mutex := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	var firstErr error
+
+	aliases := make(map[string][]string)
+	for name, referenceURL := range manifest {
+		aliases[referenceURL] = append(aliases[referenceURL], name)
+	}
+
+	services := make(map[string]definitions.Service)
+	for referenceURL, names := range aliases {
+		sort.Strings(names)
+		wg.Add(1)
+		go func(n []string, u string) {
+			s, err := fetchService(ctx, src, strings.Join(n, ", "), u)
+
+			mutex.Lock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+				cancel()
+			}
+			for _, name := range n {
+				services[name] = s
+			}
+			mutex.Unlock()
+			wg.Done()
+		}(names, referenceURL)
 	}
+	wg.Wait()
 
-	if err := ioutil.WriteFile("services.go", source, 0664); err != nil {
-		log.Fatalln("error: failed to save services.go: ", err)
+	if firstErr != nil {
+		return nil, firstErr
 	}
+	return services, nil
 }
 
-// fetchService uses go-got to fetch the definition of a service and parses it
+// fetchService fetches the definition of a service from src and parses it
 // into a usable go object.
-func fetchService(g *got.Got, name string, url string) definitions.Service {
+func fetchService(ctx context.Context, src source, name string, url string) (definitions.Service, error) {
 	log.Println(" - fetching", name)
 	// Fetch reference
-	res, err := g.Get(url).Send()
+	var s definitions.Service
+	body, err := src.Get(ctx, url)
 	if err != nil {
-		log.Fatalln("error: failed to fetch API ", name, ": ", err)
+		return s, fmt.Errorf("failed to fetch API %s: %s", name, err)
 	}
 	// Parse reference
-	var s definitions.Service
-	if err := json.Unmarshal(res.Body, &s); err != nil {
-		log.Fatalln("error: failed parse API ", name, ": ", err)
+	if err := json.Unmarshal(body, &s); err != nil {
+		return s, fmt.Errorf("failed to parse API %s: %s", name, err)
 	}
-	return s
+	return s, nil
 }
 
-// fetchSchema uses go-got to fetch the schema of an input or output and ensures
-// that it parses as valid JSON.
-func fetchSchema(g *got.Got, url string) string {
+// fetchSchema fetches the schema of an input or output from src and ensures
+// that it parses as valid JSON and looks like a JSON schema.
+func fetchSchema(ctx context.Context, src source, url string) (string, error) {
 	log.Println(" -", url)
-	res, err := g.Get(url).Send()
+	body, err := src.Get(ctx, url)
 	if err != nil {
-		log.Fatalln("error: failed to fetch ", url, ": ", err)
+		return "", fmt.Errorf("failed to fetch %s: %s", url, err)
 	}
 	// Test that we can parse the JSON schema (otherwise it's invalid)
 	var i interface{}
-	if err := json.Unmarshal(res.Body, &i); err != nil {
-		log.Fatalln("error: failed to parse ", url, ": ", err)
+	if err := json.Unmarshal(body, &i); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %s", url, err)
+	}
+	if !isSchema(i) {
+		return "", fmt.Errorf("%s is not a JSON schema", url)
+	}
+	return string(body), nil
+}
+
+// isSchema returns true if doc has the shape of a JSON schema: an object or a
+// boolean. This rejects other JSON documents, such as lists or strings, served
+// in place of a schema; whether it is a valid schema is left to the
+// meta-schema check of -schema-validation.
+func isSchema(doc interface{}) bool {
+	switch doc.(type) {
+	case map[string]interface{}, bool:
+		return true
+	default:
+		return false
+	}
+}
+
+// invalidSchemas validates each of the given schemas, keyed by URL, against
+// the meta-schema it declares with $schema, fetched from src. It lists the
+// validation errors as sorted "url: error" lines. Schemas without $schema are
+// not validated. If requireHTTPS is true, meta-schemas not served over https
+// are an error.
+func invalidSchemas(ctx context.Context, src source, schemas map[string]string, requireHTTPS bool) ([]string, error) {
+	metas := make(map[string]string)
+	var invalid []string
+	for u, s := range schemas {
+		var declared struct {
+			Schema string `json:"$schema"`
+		}
+		if err := json.Unmarshal([]byte(s), &declared); err != nil || declared.Schema == "" {
+			continue
+		}
+
+		meta, ok := metas[declared.Schema]
+		if !ok {
+			if requireHTTPS && !isHTTPS(declared.Schema) {
+				return nil, fmt.Errorf("meta-schema of %s not served over https: %s", u, declared.Schema)
+			}
+			body, err := src.Get(ctx, declared.Schema)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch meta-schema %s: %s", declared.Schema, err)
+			}
+			meta = string(body)
+			metas[declared.Schema] = meta
+		}
+
+		result, err := gojsonschema.Validate(
+			gojsonschema.NewStringLoader(meta), gojsonschema.NewStringLoader(s),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to validate %s against %s: %s", u, declared.Schema, err)
+		}
+		for _, e := range result.Errors() {
+			invalid = append(invalid, u+": "+e.String())
+		}
+	}
+	sort.Strings(invalid)
+	return invalid, nil
+}
+
+// resolveRefs returns the given schemas, keyed by URL, with every $ref
+// replaced by what it points to, so that each of them can be used on its own.
+// References are resolved against the URL of the document they appear in, and
+// must point into one of the given schemas. Circular references cannot be
+// inlined and are reported as errors.
+func resolveRefs(schemas map[string]string) (map[string]string, error) {
+	r := &refResolver{
+		docs:   make(map[string]interface{}, len(schemas)),
+		active: make(map[string]bool),
+	}
+	for u, s := range schemas {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(s), &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", u, err)
+		}
+		r.docs[stripFragment(u)] = doc
+	}
+
+	resolved := make(map[string]string, len(schemas))
+	for u := range schemas {
+		doc, err := r.resolve(r.docs[stripFragment(u)], stripFragment(u))
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve references in %s: %s", u, err)
+		}
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		resolved[u] = string(data)
+	}
+	return resolved, nil
+}
+
+// refResolver holds the parsed schemas, by URL without fragment, and the
+// references being inlined, to detect cycles.
+type refResolver struct {
+	docs   map[string]interface{}
+	active map[string]bool
+}
+
+// resolve returns a copy of v, part of the document at base, with its
+// references inlined.
+func (r *refResolver) resolve(v interface{}, base string) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if ref, ok := v["$ref"].(string); ok {
+			return r.inline(ref, base)
+		}
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			e, err := r.resolve(e, base)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = e
+		}
+		return m, nil
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			e, err := r.resolve(e, base)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = e
+		}
+		return a, nil
+	default:
+		return v, nil
+	}
+}
+
+// inline returns the resolved target of ref, found in the document at base.
+func (r *refResolver) inline(ref, base string) (interface{}, error) {
+	b, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid $ref %s: %s", ref, err)
+	}
+	target := b.ResolveReference(u)
+	if r.active[target.String()] {
+		return nil, fmt.Errorf("circular $ref %s", target)
+	}
+
+	pointer := target.Fragment
+	docURL := stripFragment(target.String())
+	doc, ok := r.docs[docURL]
+	if !ok {
+		return nil, fmt.Errorf("$ref %s points to %s, which is not part of the manifest", ref, docURL)
+	}
+	node, err := jsonPointer(doc, pointer)
+	if err != nil {
+		return nil, fmt.Errorf("$ref %s: %s", ref, err)
+	}
+
+	r.active[target.String()] = true
+	defer delete(r.active, target.String())
+	return r.resolve(node, docURL)
+}
+
+// stripFragment returns rawurl without its fragment, if any.
+func stripFragment(rawurl string) string {
+	if i := strings.Index(rawurl, "#"); i >= 0 {
+		return rawurl[:i]
+	}
+	return rawurl
+}
+
+// jsonPointer returns the part of doc the JSON pointer p refers to, the whole
+// document if p is empty.
+func jsonPointer(doc interface{}, p string) (interface{}, error) {
+	if p == "" {
+		return doc, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", p)
+	}
+	for _, token := range strings.Split(p[1:], "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			e, ok := v[token]
+			if !ok {
+				return nil, fmt.Errorf("%q not found", p)
+			}
+			doc = e
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("%q not found", p)
+			}
+			doc = v[i]
+		default:
+			return nil, fmt.Errorf("%q not found", p)
+		}
+	}
+	return doc, nil
+}
+
+// dedupByContent returns the distinct bodies of the given schemas, keyed by
+// their hex-encoded SHA-256, along with the key of each schema URL.
+func dedupByContent(schemas map[string]string) (map[string]string, map[string]string) {
+	bodies := make(map[string]string)
+	keys := make(map[string]string, len(schemas))
+	for url, s := range schemas {
+		sum := sha256.Sum256([]byte(s))
+		key := hex.EncodeToString(sum[:])
+		bodies[key] = s
+		keys[url] = key
+	}
+	return bodies, keys
+}
+
+// compressSchemas returns the given schemas gzipped, by key. The output only
+// depends on the schemas, so that regenerating services.go from the same
+// schemas gives the same file.
+func compressSchemas(schemas map[string]string) (map[string][]byte, error) {
+	compressed := make(map[string][]byte, len(schemas))
+	for url, s := range schemas {
+		buf := &bytes.Buffer{}
+		w, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(s)); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		compressed[url] = buf.Bytes()
+	}
+	return compressed, nil
+}
+
+// insecureReferences lists the services in the manifest whose reference is not
+// served over https, as sorted "name: url" lines.
+func insecureReferences(manifest map[string]string) []string {
+	var insecure []string
+	for name, referenceURL := range manifest {
+		if !isHTTPS(referenceURL) {
+			insecure = append(insecure, name+": "+referenceURL)
+		}
+	}
+	sort.Strings(insecure)
+	return insecure
+}
+
+// insecureSchemas lists the entries whose input or output schema is not
+// served over https, as sorted "service.entry input|output: url" lines.
+func insecureSchemas(services map[string]definitions.Service) []string {
+	var insecure []string
+	for name, s := range services {
+		for _, e := range s.Entries {
+			if e.Input != "" && !isHTTPS(e.Input) {
+				insecure = append(insecure, name+"."+e.Name+" input: "+e.Input)
+			}
+			if e.Output != "" && !isHTTPS(e.Output) {
+				insecure = append(insecure, name+"."+e.Name+" output: "+e.Output)
+			}
+		}
+	}
+	sort.Strings(insecure)
+	return insecure
+}
+
+// isHTTPS returns true if rawurl is an https URL.
+func isHTTPS(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	return err == nil && u.Scheme == "https"
+}
+
+// newClient returns the HTTP client shared by all fetches, giving up on each
+// request after timeout. References and schemas are served from a handful of
+// hosts, so unless keepAlives is false it keeps enough idle connections per
+// host for the concurrent fetches to reuse them. Proxies are taken from the
+// environment (HTTP_PROXY, HTTPS_PROXY and NO_PROXY), and the certificates in
+// caFile, if given, are trusted in addition to the system ones.
+func newClient(timeout time.Duration, caFile string, keepAlives bool) (*http.Client, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     !keepAlives,
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}, nil
+}
+
+// defaultCacheDir returns the directory responses are cached in by default,
+// following the XDG base directory specification, or "" if there is no home
+// directory to put it in.
+func defaultCacheDir() string {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		home, err := homedir.Dir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(dir, "taskcluster-cli", "fetch-apis")
+}
+
+// installCache makes c cache its responses in dir with a cachingTransport.
+// The cache is only an optimisation, so if dir cannot be created, e.g. in a
+// read-only home directory, a warning is logged and c is left uncached.
+func installCache(c *http.Client, dir string, revalidate bool) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Println("warning: caching disabled, failed to create cache directory:", err)
+		return
+	}
+	transport := c.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	c.Transport = &cachingTransport{
+		dir:        dir,
+		revalidate: revalidate,
+		transport:  transport,
+	}
+}
+
+// cacheEntry is a response saved by cachingTransport, along with the
+// validators used to check whether it is still fresh.
+type cacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Body         []byte `json:"body"`
+}
+
+// cachingTransport is an http.RoundTripper saving successful responses to GET
+// requests in dir. Unless revalidate is false, requests for saved responses
+// are made conditional with If-None-Match and If-Modified-Since, and a 304
+// response is answered with the saved body, so documents are only downloaded
+// again when they changed. Responses without an ETag or Last-Modified header
+// cannot be revalidated and are not saved.
+type cachingTransport struct {
+	dir        string
+	revalidate bool
+	transport  http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return t.transport.RoundTrip(req)
+	}
+
+	key := req.URL.String()
+	var entry *cacheEntry
+	if t.revalidate {
+		entry = t.load(key)
+	}
+	if entry != nil {
+		// A RoundTripper must not modify the request it is given.
+		r := new(http.Request)
+		*r = *req
+		r.Header = make(http.Header, len(req.Header)+2)
+		for k, v := range req.Header {
+			r.Header[k] = v
+		}
+		if entry.ETag != "" {
+			r.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			r.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+		req = r
+	}
+
+	res, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotModified && entry != nil {
+		res.Body.Close()
+		res.Status = "200 OK"
+		res.StatusCode = http.StatusOK
+		res.ContentLength = int64(len(entry.Body))
+		res.Body = ioutil.NopCloser(bytes.NewReader(entry.Body))
+		return res, nil
+	}
+
+	etag, lastModified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	if res.StatusCode != http.StatusOK || (etag == "" && lastModified == "") {
+		return res, nil
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	err = t.store(&cacheEntry{
+		URL:          key,
+		ETag:         etag,
+		LastModified: lastModified,
+		Body:         body,
+	})
+	if err != nil {
+		log.Println("warning: failed to cache", key, err)
+	}
+	return res, nil
+}
+
+// path returns the file the response for url is saved in.
+func (t *cachingTransport) path(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(t.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// load returns the saved response for url, or nil if there is none. Entries
+// that cannot be read are ignored, they are overwritten by the next response.
+func (t *cachingTransport) load(url string) *cacheEntry {
+	data, err := ioutil.ReadFile(t.path(url))
+	if err != nil {
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.URL != url {
+		return nil
+	}
+	return &entry
+}
+
+// store saves entry, replacing the previous one atomically so that concurrent
+// runs never see a partial file.
+func (t *cachingTransport) store(entry *cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.path(entry.URL), data, 0600)
+}
+
+// credentialsFromEnv returns the TaskCluster credentials given in the
+// environment, or nil if there are none.
+func credentialsFromEnv() *client.Credentials {
+	clientID := os.Getenv("TASKCLUSTER_CLIENT_ID")
+	accessToken := os.Getenv("TASKCLUSTER_ACCESS_TOKEN")
+	if clientID == "" || accessToken == "" {
+		return nil
+	}
+	return &client.Credentials{
+		ClientID:    clientID,
+		AccessToken: accessToken,
+		Certificate: os.Getenv("TASKCLUSTER_CERTIFICATE"),
+	}
+}
+
+// source provides the documents services.go is generated from, by URL.
+type source interface {
+	Get(ctx context.Context, url string) ([]byte, error)
+}
+
+// ctxTransport aborts requests made through transport once ctx is done, on
+// top of whatever already bounds them, such as the client's timeout.
+type ctxTransport struct {
+	ctx       context.Context
+	transport http.RoundTripper
+}
+
+func (t *ctxTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if err := t.ctx.Err(); err != nil {
+		return nil, err
+	}
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		select {
+		case <-t.ctx.Done():
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	res, err := transport.RoundTrip(r.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// cancelOnClose releases the context of a request once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// fetcher retrieves documents over HTTP, signing https requests to signHost
+// when credentials are given and making all others anonymously. When slots is non-nil, its
+// capacity bounds the number of requests in flight. When snapshot is non-nil,
+// the body of every successful response is also kept there, keyed by URL.
+type fetcher struct {
+	got         *got.Got
+	credentials *client.Credentials
+	signHost    string
+	slots       chan struct{}
+	mutex       sync.Mutex
+	snapshot    map[string][]byte
+}
+
+// signs reports whether requests to rawurl should carry the credentials, only
+// those over https to the deployment itself do.
+func (f *fetcher) signs(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	return err == nil && u.Scheme == "https" && u.Host != "" && u.Host == f.signHost
+}
+
+// Get fetches the given url and returns the body of the response. It gives up
+// as soon as ctx is done, aborting the attempt in flight and any retries left.
+func (f *fetcher) Get(ctx context.Context, url string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	req := f.got.Get(url)
+	c := http.DefaultClient
+	if req.Client != nil {
+		c = req.Client
+	}
+	bounded := *c
+	bounded.Transport = &ctxTransport{ctx: ctx, transport: c.Transport}
+	req.Client = &bounded
+	transient := req.IsTransient
+	req.IsTransient = func(err error, res *got.Response) bool {
+		return ctx.Err() == nil && transient(err, res)
+	}
+	if f.credentials != nil && f.signs(url) {
+		if err := f.credentials.SignGotRequest(req, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	// Wait for a slot to be free, the request releases it once done.
+	if f.slots != nil {
+		select {
+		case f.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	type result struct {
+		res *got.Response
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := req.Send()
+		if f.slots != nil {
+			<-f.slots
+		}
+		done <- result{res, err}
+	}()
+
+	var res *got.Response
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		res = r.res
+	}
+	if f.snapshot != nil {
+		f.mutex.Lock()
+		f.snapshot[url] = res.Body
+		f.mutex.Unlock()
+	}
+	return res.Body, nil
+}
+
+// snapshotIndex is saved as index.json at the root of a snapshot. It records
+// the manifest URL and maps every fetched URL to the file holding its body,
+// relative to the snapshot directory.
+type snapshotIndex struct {
+	Manifest string            `json:"manifest"`
+	Files    map[string]string `json:"files"`
+}
+
+// writeSnapshot saves the given documents under dir, laid out by host and
+// path, along with an index.json describing them.
+func writeSnapshot(dir, manifest string, docs map[string][]byte) error {
+	index := snapshotIndex{
+		Manifest: manifest,
+		Files:    make(map[string]string, len(docs)),
+	}
+	for u, body := range docs {
+		rel, err := snapshotPath(u)
+		if err != nil {
+			return err
+		}
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0775); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, body, 0664); err != nil {
+			return err
+		}
+		index.Files[u] = rel
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "index.json"), data, 0664)
+}
+
+// snapshotSource reads documents from a snapshot saved by writeSnapshot.
+type snapshotSource struct {
+	dir   string
+	index snapshotIndex
+}
+
+// openSnapshot reads the index of the snapshot saved in dir.
+func openSnapshot(dir string) (*snapshotSource, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshotSource{dir: dir}
+	if err := json.Unmarshal(data, &s.index); err != nil {
+		return nil, fmt.Errorf("failed to parse index.json: %s", err)
+	}
+	for u, rel := range s.index.Files {
+		if !isLocalPath(rel) {
+			return nil, fmt.Errorf("index.json: file of %s is outside the snapshot: %s", u, rel)
+		}
+	}
+	return s, nil
+}
+
+// Get returns the body saved for url.
+func (s *snapshotSource) Get(ctx context.Context, url string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	rel, ok := s.index.Files[url]
+	if !ok {
+		return nil, fmt.Errorf("%s is not part of the snapshot", url)
+	}
+	return ioutil.ReadFile(filepath.Join(s.dir, filepath.FromSlash(rel)))
+}
+
+// snapshotPath returns the slash-separated path at which the body of rawurl
+// is stored in a snapshot, e.g. the schema
+// http://schemas.taskcluster.net/auth/v1/client.json# is saved as
+// schemas.taskcluster.net/auth/v1/client.json. URLs with a query string are
+// rejected, as they would share a file with the same URL without it.
+func snapshotPath(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if u.RawQuery != "" || u.ForceQuery {
+		return "", fmt.Errorf("cannot store %s in a snapshot, it has a query string", rawurl)
+	}
+	p := path.Join(u.Host, u.Path)
+	if u.Host == "" || u.Host == "." || u.Host == ".." ||
+		!strings.HasPrefix(p, u.Host+"/") || !isLocalPath(p) {
+		return "", fmt.Errorf("cannot store %s in a snapshot", rawurl)
+	}
+	return p, nil
+}
+
+// isLocalPath returns true if the slash-separated path rel names a file
+// within the directory it is relative to.
+func isLocalPath(rel string) bool {
+	p := path.Clean(rel)
+	return p != "." && p != ".." && !strings.HasPrefix(p, "../") &&
+		!path.IsAbs(p) && !strings.Contains(p, "\\")
+}
+
+// schemaTypes builds Go type definitions from JSON schemas. Objects with
+// properties become structs, other types map to the closest Go type, and
+// anything that cannot be typed, such as an unresolved $ref, becomes
+// interface{}.
+type schemaTypes struct {
+	defs   map[string]string // definition of each type, by name
+	shared map[string]string // name of each struct, by definition
+	docs   map[string]string // doc comment of top-level types, by name
+}
+
+// add defines a type for schema, named name or, if that is taken, name
+// followed by a number, and returns the name used.
+func (st *schemaTypes) add(schema interface{}, name string) string {
+	name = st.unique(name)
+	typ := st.goType(schema, name)
+	if typ != name {
+		st.defs[name] = typ
+	}
+	return name
+}
+
+// unique returns name, followed by a number if a type with that name exists.
+func (st *schemaTypes) unique(name string) string {
+	if _, ok := st.defs[name]; !ok {
+		return name
+	}
+	for i := 2; ; i++ {
+		n := name + strconv.Itoa(i)
+		if _, ok := st.defs[n]; !ok {
+			return n
+		}
+	}
+}
+
+// goType returns the Go type for schema, defining a struct named name, or
+// reusing an identical one, if schema is an object with properties.
+func (st *schemaTypes) goType(schema interface{}, name string) string {
+	m, ok := schema.(map[string]interface{})
+	if !ok {
+		return "interface{}"
+	}
+
+	switch schemaType(m) {
+	case "string":
+		return "string"
+	case "integer":
+		return "int64"
+	case "number":
+		return "float64"
+	case "boolean":
+		return "bool"
+	case "array":
+		return "[]" + st.goType(m["items"], name+"Item")
+	case "object":
+		properties, _ := m["properties"].(map[string]interface{})
+		if len(properties) == 0 {
+			if additional, ok := m["additionalProperties"].(map[string]interface{}); ok {
+				return "map[string]" + st.goType(additional, name+"Value")
+			}
+			return "map[string]interface{}"
+		}
+		return st.structType(m, properties, name)
+	default:
+		return "interface{}"
 	}
-	return string(res.Body)
+}
+
+// structType returns the name of the struct for an object schema with the
+// given properties.
+func (st *schemaTypes) structType(schema, properties map[string]interface{}, name string) string {
+	required := make(map[string]bool)
+	if r, ok := schema["required"].([]interface{}); ok {
+		for _, p := range r {
+			if p, ok := p.(string); ok {
+				required[p] = true
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(properties))
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// The name of the struct is only known once its fields are, so nested
+	// structs are named after the one it would get.
+	name = st.unique(name)
+	fields := make(map[string]bool, len(keys))
+	def := &bytes.Buffer{}
+	def.WriteString("struct {\n")
+	for _, k := range keys {
+		field := goName(k)
+		for i := 2; fields[field]; i++ {
+			field = goName(k) + strconv.Itoa(i)
+		}
+		fields[field] = true
+		typ, tag := st.goType(properties[k], name+field), k
+		if !required[k] {
+			// Optional scalars and structs are pointers, so that leaving them
+			// out is not mistaken for their zero value. Slices, maps and
+			// interfaces can already be nil.
+			if !nilable(typ) {
+				typ = "*" + typ
+			}
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(def, "%s %s `json:%q`\n", field, typ, tag)
+	}
+	def.WriteString("}")
+
+	if existing, ok := st.shared[def.String()]; ok {
+		return existing
+	}
+	st.defs[name] = def.String()
+	st.shared[def.String()] = name
+	return name
+}
+
+// nilable reports whether the Go type typ, as returned by goType, has nil as
+// its zero value.
+func nilable(typ string) bool {
+	return typ == "interface{}" || strings.HasPrefix(typ, "[]") || strings.HasPrefix(typ, "map[")
+}
+
+// schemaType returns the type declared by schema, ignoring "null" when it is
+// one of several types, and "object" for schemas with properties but no type.
+func schemaType(schema map[string]interface{}) string {
+	switch t := schema["type"].(type) {
+	case string:
+		return t
+	case []interface{}:
+		var types []string
+		for _, v := range t {
+			if v, ok := v.(string); ok && v != "null" {
+				types = append(types, v)
+			}
+		}
+		if len(types) == 1 {
+			return types[0]
+		}
+		return ""
+	}
+	if _, ok := schema["properties"]; ok {
+		return "object"
+	}
+	return ""
+}
+
+// goName turns a JSON property or entry name into an exported Go identifier,
+// e.g. "createTask" into "CreateTask" and "task-id" into "TaskID".
+func goName(s string) string {
+	parts := strings.FieldsFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	})
+	name := ""
+	for _, p := range parts {
+		if strings.ToLower(p) == "id" || strings.ToLower(p) == "url" {
+			name += strings.ToUpper(p)
+			continue
+		}
+		name += strings.ToUpper(p[:1]) + p[1:]
+	}
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "X" + name
+	}
+	return name
 }
 
 // generator holds a buffer of the output that will be generated.
@@ -169,10 +1445,36 @@ func (g *generator) Print(a ...interface{}) {
 // output, but simple types such as strings and numbers are printed using the
 // built-in `%#v` format filter.
 func (g *generator) PrettyPrint(data interface{}) {
+	// Values of interface type reach us as their dynamic value, which is
+	// printed as is, or as nil, which has no type to print.
+	if data == nil {
+		g.Print("nil")
+		return
+	}
+
 	v := reflect.ValueOf(data)
 	t := v.Type()
 
 	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			g.Printf("(%s)(nil)", t.String())
+			break
+		}
+		e := v.Elem()
+		switch {
+		case e.Kind() == reflect.Struct || e.Kind() == reflect.Array,
+			e.Kind() == reflect.Slice && !e.IsNil(),
+			e.Kind() == reflect.Map && !e.IsNil():
+			g.Print("&")
+			g.PrettyPrint(e.Interface())
+		default:
+			// There is no literal for pointers to other values, so we take the
+			// address of a variable holding the value.
+			g.Printf("func() %s {\nvar v %s = ", t.String(), t.Elem().String())
+			g.PrettyPrint(e.Interface())
+			g.Print("\nreturn &v\n}()")
+		}
 	case reflect.Array, reflect.Slice:
 		g.Printf("%s", t.String())
 		if v.Kind() == reflect.Slice && v.IsNil() {
@@ -194,7 +1496,12 @@ func (g *generator) PrettyPrint(data interface{}) {
 		}
 		g.Print("}")
 	case reflect.Map:
-		g.Printf("%s{\n", t.String())
+		g.Printf("%s", t.String())
+		if v.IsNil() {
+			g.Printf("(nil)")
+			break
+		}
+		g.Print("{\n")
 		keys := v.MapKeys()
 		if len(keys) == 0 {
 			g.Print("}")
@@ -230,9 +1537,112 @@ func (g *generator) PrettyPrint(data interface{}) {
 	}
 }
 
-// Format returns the formated contents of the generator's buffer.
+// PrintCompressedSchemas prints the given gzipped schemas as the
+// compressedSchemas of the apis package, leaving the schemas map empty until
+// the apis package decompresses them on first use.
+func (g *generator) PrintCompressedSchemas(compressed map[string][]byte) {
+	urls := make([]string, 0, len(compressed))
+	for url := range compressed {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	g.Print("var schemas map[string]string\n\n")
+	g.Print("func init() {\n")
+	g.Print("compressedSchemas = map[string][]byte{\n")
+	for _, url := range urls {
+		g.Printf("%q: []byte(%q),\n", url, compressed[url])
+	}
+	g.Print("}\n")
+	g.Print("}\n")
+}
+
+// PrintSchemaTypes prints a Go type for the input and output schema of every
+// entry of services, e.g. QueueCreateTaskRequest and QueueCreateTaskResponse
+// for the input and output of Queue.createTask. A schema shared by several
+// entries gets a single type, named after the first of them, and identical
+// nested objects share a single struct.
+func (g *generator) PrintSchemaTypes(services map[string]definitions.Service, schemas map[string]string) error {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	st := &schemaTypes{
+		defs:   make(map[string]string),
+		shared: make(map[string]string),
+		docs:   make(map[string]string),
+	}
+	done := make(map[string]bool)
+	addSchema := func(url, name string) error {
+		if url == "" || done[url] {
+			return nil
+		}
+		done[url] = true
+		var schema interface{}
+		if err := json.Unmarshal([]byte(schemas[url]), &schema); err != nil {
+			return fmt.Errorf("failed to parse %s: %s", url, err)
+		}
+		name = st.add(schema, name)
+		st.docs[name] = fmt.Sprintf("// %s is generated from %s", name, url)
+		return nil
+	}
+	for _, name := range names {
+		for _, e := range services[name].Entries {
+			prefix := name + goName(e.Name)
+			if err := addSchema(e.Input, prefix+"Request"); err != nil {
+				return err
+			}
+			if err := addSchema(e.Output, prefix+"Response"); err != nil {
+				return err
+			}
+		}
+	}
+
+	types := make([]string, 0, len(st.defs))
+	for name := range st.defs {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	for _, name := range types {
+		if doc, ok := st.docs[name]; ok {
+			g.Print(doc, "\n")
+		}
+		g.Printf("type %s %s\n\n", name, st.defs[name])
+	}
+	return nil
+}
+
+// Format returns the formated contents of the generator's buffer. If they
+// do not parse, the error includes the lines around the first syntax error.
 func (g *generator) Format() ([]byte, error) {
-	return format.Source(g.buf.Bytes())
+	code, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		if list, ok := err.(scanner.ErrorList); ok && len(list) > 0 {
+			return nil, fmt.Errorf("%s\n%s", err, g.snippet(list[0].Pos.Line, 3))
+		}
+		return nil, err
+	}
+	return code, nil
+}
+
+// snippet returns the given line of the buffer along with around lines on
+// either side, numbered, the given line being marked with ">".
+func (g *generator) snippet(line, around int) string {
+	lines := strings.Split(g.buf.String(), "\n")
+	buf := &bytes.Buffer{}
+	for i := line - around; i <= line+around; i++ {
+		if i < 1 || i > len(lines) {
+			continue
+		}
+		marker := " "
+		if i == line {
+			marker = ">"
+		}
+		fmt.Fprintf(buf, "%s%5d | %s\n", marker, i, lines[i-1])
+	}
+	return buf.String()
 }
 
 // String returns a string representation of the generator's buffer.
@@ -0,0 +1,1134 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+	got "github.com/taskcluster/go-got"
+	"github.com/taskcluster/taskcluster-cli/apis/definitions"
+	"github.com/taskcluster/taskcluster-cli/client"
+	"github.com/taskcluster/taskcluster-cli/testutil"
+)
+
+func TestGenerateServices(t *testing.T) {
+	assert := assert.New(t)
+
+	c := testutil.NewFakeCluster(testutil.Config{
+		Services: []testutil.Service{
+			testutil.Service{
+				Name:  "Queue",
+				Title: "Queue API",
+				Entries: []definitions.Entry{
+					definitions.Entry{
+						Name:  "task",
+						Input: "/schemas/queue/v1/task.json#",
+					},
+				},
+			},
+		},
+		Schemas: map[string]string{
+			"queue/v1/task.json": `{"type": "object"}`,
+		},
+	})
+	defer c.Close()
+
+	f := &fetcher{got: got.New()}
+	source, err := generateServices(context.Background(), f, c.ManifestURL(), options{})
+	assert.NoError(err)
+	assert.Contains(string(source), `"Queue": definitions.Service{`)
+	assert.Contains(string(source), fmt.Sprintf(`%q: "{\"type\": \"object\"}"`, c.SchemaURL("queue/v1/task.json#")))
+
+	_, err = generateServices(context.Background(), f, c.URL+"/references/missing.json", options{})
+	assert.Error(err)
+	assert.Contains(err.Error(), "failed to fetch api manifest")
+}
+
+func TestGenerateServicesSchemaFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	c := testutil.NewFakeCluster(testutil.Config{
+		Services: []testutil.Service{
+			testutil.Service{
+				Name: "Queue",
+				Entries: []definitions.Entry{
+					definitions.Entry{Name: "task", Output: "/schemas/queue/v1/missing.json#"},
+					definitions.Entry{Name: "status", Output: "/schemas/queue/v1/invalid.json#"},
+				},
+			},
+		},
+		Schemas: map[string]string{
+			"queue/v1/invalid.json": `{"type": `,
+		},
+	})
+	defer c.Close()
+
+	_, err := generateServices(context.Background(), &fetcher{got: got.New()}, c.ManifestURL(), options{})
+	assert.Error(err, "a failed schema fetch is returned rather than exiting")
+	assert.Contains(err.Error(), "/schemas/queue/v1/")
+}
+
+func TestFetchServicesSharedReference(t *testing.T) {
+	assert := assert.New(t)
+
+	c := testutil.NewFakeCluster(testutil.Config{
+		Services: []testutil.Service{
+			testutil.Service{Name: "Queue", Title: "Queue API"},
+		},
+	})
+	defer c.Close()
+
+	manifest := map[string]string{
+		"Queue":    c.ReferenceURL("Queue"),
+		"QueueOld": c.ReferenceURL("Queue"),
+	}
+	services, err := fetchServices(context.Background(), &fetcher{got: got.New()}, manifest)
+	assert.NoError(err)
+
+	assert.Len(services, 2)
+	assert.Equal("Queue API", services["Queue"].Title)
+	assert.Equal("Queue API", services["QueueOld"].Title)
+	assert.Equal(1, c.Hits("/references/queue/v1/api.json"))
+}
+
+func TestManifestFromRootURL(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("https://tc.example.com/references/manifest.json", manifestFromRootURL("https://tc.example.com"))
+	assert.Equal("https://tc.example.com/references/manifest.json", manifestFromRootURL("https://tc.example.com/"))
+}
+
+func TestInsecureURLs(t *testing.T) {
+	assert := assert.New(t)
+
+	manifest := map[string]string{
+		"Auth":  "https://references.taskcluster.net/auth/v1/api.json",
+		"Queue": "http://references.taskcluster.net/queue/v1/api.json",
+		"Index": "HTTP://references.taskcluster.net/index/v1/api.json",
+	}
+	assert.Equal([]string{
+		"Index: HTTP://references.taskcluster.net/index/v1/api.json",
+		"Queue: http://references.taskcluster.net/queue/v1/api.json",
+	}, insecureReferences(manifest))
+
+	services := map[string]definitions.Service{
+		"Queue": definitions.Service{
+			Entries: []definitions.Entry{
+				definitions.Entry{
+					Name:   "createTask",
+					Input:  "http://schemas.taskcluster.net/queue/v1/create-task-request.json#",
+					Output: "https://schemas.taskcluster.net/queue/v1/task-status-response.json#",
+				},
+				definitions.Entry{Name: "ping"},
+			},
+		},
+	}
+	assert.Equal([]string{
+		"Queue.createTask input: http://schemas.taskcluster.net/queue/v1/create-task-request.json#",
+	}, insecureSchemas(services))
+}
+
+func TestNewClientCAFile(t *testing.T) {
+	assert := assert.New(t)
+
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer s.Close()
+
+	f, err := ioutil.TempFile("", "fetch-apis-ca")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+	assert.NoError(pem.Encode(f, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: s.TLS.Certificates[0].Certificate[0],
+	}))
+	assert.NoError(f.Close())
+
+	client, err := newClient(time.Minute, "", true)
+	assert.NoError(err)
+	_, err = client.Get(s.URL)
+	assert.Error(err, "the test server's certificate is not trusted by default")
+
+	client, err = newClient(time.Minute, f.Name(), true)
+	assert.NoError(err)
+	res, err := client.Get(s.URL)
+	assert.NoError(err)
+	res.Body.Close()
+
+	_, err = newClient(time.Minute, os.DevNull, true)
+	assert.Error(err, "a CA file without certificates is rejected")
+}
+
+func TestFetcherCanceled(t *testing.T) {
+	assert := assert.New(t)
+
+	hang := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer s.Close()
+	defer close(hang)
+
+	f := &fetcher{got: got.New()}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := f.Get(ctx, s.URL)
+	assert.Equal(context.DeadlineExceeded, err)
+
+	_, err = f.Get(ctx, s.URL)
+	assert.Equal(context.DeadlineExceeded, err, "nothing is fetched once ctx is done")
+}
+
+func TestFetcherConcurrency(t *testing.T) {
+	assert := assert.New(t)
+
+	mutex := sync.Mutex{}
+	inFlight, maxInFlight := 0, 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mutex.Lock()
+		inFlight--
+		mutex.Unlock()
+		w.Write([]byte("{}"))
+	}))
+	defer s.Close()
+
+	f := &fetcher{got: got.New(), slots: make(chan struct{}, 3)}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := f.Get(context.Background(), s.URL); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.True(maxInFlight <= 3, "at most 3 requests should be in flight")
+	assert.True(maxInFlight > 1, "requests should still run concurrently")
+}
+
+func TestFetcherRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	hits := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if hits == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer s.Close()
+
+	g := got.New()
+	g.Retries = 1
+	f := &fetcher{got: g}
+	body, err := f.Get(context.Background(), s.URL)
+	assert.NoError(err)
+	assert.Equal("{}", string(body))
+	assert.Equal(2, hits)
+
+	hits = 0
+	g.Retries = 0
+	_, err = f.Get(context.Background(), s.URL)
+	assert.Error(err, "5xx responses fail once retries are exhausted")
+}
+
+func TestFetcherTimeoutRetriesDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	var hits int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/fail-once":
+			if n == 1 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("{}"))
+		case "/fail":
+			time.Sleep(20 * time.Millisecond)
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		case "/hang":
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+		}
+	}))
+	defer s.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		timeout  time.Duration
+		retries  int
+		deadline time.Duration
+		hits     int32 // 0 when it depends on timing
+		err      error // context.DeadlineExceeded, errAny or nil
+	}{
+		{"retried until it succeeds", "/fail-once", time.Second, 1, 0, 2, nil},
+		{"retries are exhausted", "/fail", time.Second, 2, 0, 3, errAny},
+		{"each attempt times out", "/hang", 20 * time.Millisecond, 2, 0, 3, errAny},
+		{"retries end before the deadline", "/hang", 20 * time.Millisecond, 1, time.Minute, 2, errAny},
+		{"deadline aborts the attempt in flight", "/hang", time.Minute, 5, 50 * time.Millisecond, 1, context.DeadlineExceeded},
+		{"deadline stops retries", "/fail", time.Second, 1000, 100 * time.Millisecond, 0, context.DeadlineExceeded},
+	}
+	for _, test := range tests {
+		assert := assert.New(t)
+		atomic.StoreInt32(&hits, 0)
+
+		g := got.New()
+		g.Client = &http.Client{Timeout: test.timeout}
+		g.Retries = test.retries
+		f := &fetcher{got: g, slots: make(chan struct{}, 1)}
+		ctx := context.Background()
+		if test.deadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, test.deadline)
+			defer cancel()
+		}
+
+		_, err := f.Get(ctx, s.URL+test.path)
+		switch test.err {
+		case nil:
+			assert.NoError(err, test.name)
+		case errAny:
+			assert.Error(err, test.name)
+			assert.NotEqual(context.DeadlineExceeded, err, test.name)
+		default:
+			assert.Equal(test.err, err, test.name)
+		}
+
+		// Nothing is left running once Get returns: the slot is freed and
+		// no further attempts are made.
+		select {
+		case f.slots <- struct{}{}:
+		case <-time.After(time.Second):
+			t.Fatal(test.name + ": the slot was not released")
+		}
+		n := atomic.LoadInt32(&hits)
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(n, atomic.LoadInt32(&hits), test.name+": no attempts are made after giving up")
+		if test.hits != 0 {
+			assert.Equal(test.hits, n, test.name)
+		}
+	}
+}
+
+// errAny stands for any error other than one from the context.
+var errAny = errors.New("any error")
+
+func TestFetcherCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	var authorization string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte("{}"))
+	})
+	s := httptest.NewTLSServer(handler)
+	defer s.Close()
+	foreign := httptest.NewTLSServer(handler)
+	defer foreign.Close()
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+
+	g := got.New()
+	g.Client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	u, err := url.Parse(s.URL)
+	assert.NoError(err)
+	f := &fetcher{got: g, signHost: u.Host}
+	_, err = f.Get(context.Background(), s.URL)
+	assert.NoError(err)
+	assert.Equal("", authorization, "requests are anonymous without credentials")
+
+	f.credentials = &client.Credentials{ClientID: "tester", AccessToken: "no-secret"}
+	_, err = f.Get(context.Background(), s.URL)
+	assert.NoError(err)
+	assert.Contains(authorization, `Hawk id="tester"`)
+
+	_, err = f.Get(context.Background(), foreign.URL)
+	assert.NoError(err)
+	assert.Equal("", authorization, "requests to other hosts are anonymous")
+
+	u, err = url.Parse(plain.URL)
+	assert.NoError(err)
+	f.signHost = u.Host
+	_, err = f.Get(context.Background(), plain.URL)
+	assert.NoError(err)
+	assert.Equal("", authorization, "requests over http are anonymous")
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	c := testutil.NewFakeCluster(testutil.Config{
+		Services: []testutil.Service{
+			testutil.Service{
+				Name: "Queue",
+				Entries: []definitions.Entry{
+					definitions.Entry{Name: "task", Output: "/schemas/queue/v1/task.json#"},
+				},
+			},
+			testutil.Service{Name: "Index"},
+		},
+		Schemas: map[string]string{
+			"queue/v1/task.json": `{"type": "object"}`,
+		},
+	})
+	defer c.Close()
+
+	dir, err := ioutil.TempDir("", "fetch-apis")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	f := &fetcher{got: got.New(), snapshot: make(map[string][]byte)}
+	online, err := generateServices(context.Background(), f, c.ManifestURL(), options{})
+	assert.NoError(err)
+	assert.NoError(writeSnapshot(dir, c.ManifestURL(), f.snapshot))
+
+	// Nothing is fetched when generating from the snapshot.
+	c.Close()
+
+	s, err := openSnapshot(dir)
+	assert.NoError(err)
+	offline, err := generateServices(context.Background(), s, s.index.Manifest, options{})
+	assert.NoError(err)
+	assert.Equal(string(online), string(offline))
+
+	_, err = s.Get(context.Background(), c.URL+"/not/in/snapshot.json")
+	assert.Error(err)
+}
+
+func TestSnapshotPath(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := snapshotPath("http://schemas.taskcluster.net/auth/v1/client.json#")
+	assert.NoError(err)
+	assert.Equal("schemas.taskcluster.net/auth/v1/client.json", p)
+
+	_, err = snapshotPath("http://references.taskcluster.net/")
+	assert.Error(err, "a URL without a path cannot be stored")
+
+	_, err = snapshotPath("http://evil.example.com/../../etc/passwd")
+	assert.Error(err, "paths must not escape the host directory")
+
+	_, err = snapshotPath("http://../../../tmp/x.json")
+	assert.Error(err, "a host of .. must not escape the snapshot directory")
+
+	_, err = snapshotPath("http://./x.json")
+	assert.Error(err)
+
+	_, err = snapshotPath("http://schemas.taskcluster.net/auth/v1/client.json?v=2")
+	assert.Error(err, "URLs differing only by query would share a file")
+
+	_, err = snapshotPath("http://schemas.taskcluster.net/auth/v1/client.json?")
+	assert.Error(err)
+}
+
+func TestOpenSnapshotOutside(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fetch-apis")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	for _, rel := range []string{"../../etc/passwd", "/etc/passwd", "a/../../b", ".."} {
+		index := fmt.Sprintf(`{"manifest": "http://x/m.json", "files": {"http://x/m.json": %q}}`, rel)
+		assert.NoError(ioutil.WriteFile(filepath.Join(dir, "index.json"), []byte(index), 0664))
+		_, err = openSnapshot(dir)
+		assert.Error(err, rel)
+		assert.Contains(err.Error(), "outside the snapshot")
+	}
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fetch-apis")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	manifest := "http://references.taskcluster.net/manifest.json"
+	docs := map[string][]byte{
+		manifest: []byte(`{"Auth": "http://references.taskcluster.net/auth/v1/api.json"}`),
+		"http://references.taskcluster.net/auth/v1/api.json":  []byte(`{"title": "Auth"}`),
+		"http://schemas.taskcluster.net/auth/v1/client.json#": []byte(`{"type": "object"}`),
+	}
+	assert.NoError(writeSnapshot(dir, manifest, docs))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	assert.NoError(err)
+	var index snapshotIndex
+	assert.NoError(json.Unmarshal(data, &index))
+	assert.Equal(manifest, index.Manifest)
+	assert.Len(index.Files, len(docs))
+
+	for u, body := range docs {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(index.Files[u])))
+		assert.NoError(err)
+		assert.Equal(body, data)
+	}
+}
+
+func TestCachingTransport(t *testing.T) {
+	assert := assert.New(t)
+
+	body, full, revalidated := `{"type": "object"}`, 0, 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidated++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(body))
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "fetch-apis-cache")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	transport := &cachingTransport{dir: dir, revalidate: true, transport: http.DefaultTransport}
+	g := got.New()
+	g.Client = &http.Client{Transport: transport}
+	f := &fetcher{got: g}
+
+	for i := 0; i < 2; i++ {
+		data, err := f.Get(context.Background(), s.URL+"/schema.json#")
+		assert.NoError(err)
+		assert.Equal(body, string(data))
+	}
+	assert.Equal(1, full)
+	assert.Equal(1, revalidated, "the cached response is revalidated rather than fetched again")
+
+	transport.revalidate = false
+	_, err = f.Get(context.Background(), s.URL+"/schema.json#")
+	assert.NoError(err)
+	assert.Equal(2, full, "the cache is bypassed when revalidation is disabled")
+}
+
+func TestResolveRefs(t *testing.T) {
+	assert := assert.New(t)
+
+	base := "https://schemas.taskcluster.net/queue/v1/"
+	resolved, err := resolveRefs(map[string]string{
+		base + "task.json#": `{
+			"type": "object",
+			"properties": {
+				"status": {"$ref": "status.json#"},
+				"deadline": {"$ref": "#/definitions/date"}
+			},
+			"definitions": {"date": {"type": "string"}}
+		}`,
+		base + "status.json#": `{"type": "object", "properties": {"runs": {"type": "array", "items": {"$ref": "run.json#"}}}}`,
+		base + "run.json#":    `{"type": "object"}`,
+	})
+	assert.NoError(err)
+
+	var task map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(resolved[base+"task.json#"]), &task))
+	properties := task["properties"].(map[string]interface{})
+	assert.Equal(map[string]interface{}{"type": "string"}, properties["deadline"])
+	assert.Equal(map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"runs": map[string]interface{}{
+				"type":  "array",
+				"items": map[string]interface{}{"type": "object"},
+			},
+		},
+	}, properties["status"])
+
+	_, err = resolveRefs(map[string]string{
+		base + "task.json#": `{"$ref": "https://example.com/other.json#"}`,
+	})
+	assert.Error(err)
+	assert.Contains(err.Error(), "not part of the manifest")
+
+	_, err = resolveRefs(map[string]string{
+		base + "tree.json#": `{"properties": {"children": {"items": {"$ref": "#"}}}}`,
+	})
+	assert.Error(err)
+	assert.Contains(err.Error(), "circular")
+}
+
+func TestJSONPointer(t *testing.T) {
+	assert := assert.New(t)
+
+	var doc interface{}
+	assert.NoError(json.Unmarshal([]byte(`{"a/b": [1, {"c~d": 2}]}`), &doc))
+
+	v, err := jsonPointer(doc, "/a~1b/1/c~0d")
+	assert.NoError(err)
+	assert.Equal(2.0, v)
+
+	v, err = jsonPointer(doc, "")
+	assert.NoError(err)
+	assert.Equal(doc, v)
+
+	_, err = jsonPointer(doc, "/a~1b/2")
+	assert.Error(err)
+	_, err = jsonPointer(doc, "a")
+	assert.Error(err)
+}
+
+func TestPrintSchemaTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	services := map[string]definitions.Service{
+		"Queue": definitions.Service{
+			Entries: []definitions.Entry{
+				definitions.Entry{Name: "createTask", Input: "task.json#", Output: "status.json#"},
+				definitions.Entry{Name: "status", Output: "status.json#"},
+				definitions.Entry{Name: "ping"},
+			},
+		},
+	}
+	schemas := map[string]string{
+		"task.json#": `{
+			"type": "object",
+			"properties": {
+				"taskGroupId": {"type": "string"},
+				"retries": {"type": "integer"},
+				"routes": {"type": "array", "items": {"type": "string"}},
+				"extra": {"type": "object"},
+				"deadline": {"type": ["string", "null"]},
+				"metadata": {"type": "object", "properties": {"name": {"type": "string"}}, "required": ["name"]}
+			},
+			"required": ["taskGroupId"]
+		}`,
+		"status.json#": `{"type": "object", "properties": {"status": {"type": "object", "properties": {"name": {"type": "string"}}, "required": ["name"]}}}`,
+	}
+
+	gen := &generator{}
+	gen.Print("package apis\n")
+	assert.NoError(gen.PrintSchemaTypes(services, schemas))
+	code, err := gen.Format()
+	assert.NoError(err, gen.String())
+
+	assert.Contains(string(code), "// QueueCreateTaskRequest is generated from task.json#\n")
+	assert.Contains(string(code), "TaskGroupId string                          `json:\"taskGroupId\"`",
+		"required properties are values")
+	assert.Contains(string(code), "Retries     *int64                          `json:\"retries,omitempty\"`",
+		"optional scalars are pointers")
+	assert.Contains(string(code), "Routes      []string                        `json:\"routes,omitempty\"`")
+	assert.Contains(string(code), "Extra       map[string]interface{}          `json:\"extra,omitempty\"`")
+	assert.Contains(string(code), "Deadline    *string                         `json:\"deadline,omitempty\"`")
+	assert.Contains(string(code), "Metadata    *QueueCreateTaskRequestMetadata `json:\"metadata,omitempty\"`",
+		"optional structs are pointers")
+	assert.Contains(string(code), "Name string `json:\"name\"`")
+	assert.Contains(string(code), "Status *QueueCreateTaskRequestMetadata `json:\"status,omitempty\"`",
+		"identical nested structs are shared")
+	assert.Contains(string(code), "type QueueCreateTaskResponse struct")
+	assert.NotContains(string(code), "QueueStatusResponse", "shared schemas get a single type")
+}
+
+func TestGoName(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("CreateTask", goName("createTask"))
+	assert.Equal("TaskID", goName("task-id"))
+	assert.Equal("X2fa", goName("2fa"))
+	assert.Equal("X", goName("$"))
+}
+
+func TestInvalidSchemas(t *testing.T) {
+	assert := assert.New(t)
+
+	c := testutil.NewFakeCluster(testutil.Config{
+		Schemas: map[string]string{
+			"meta.json": `{"type": "object", "properties": {"type": {"enum": ["object", "string"]}}}`,
+		},
+	})
+	defer c.Close()
+
+	meta := c.SchemaURL("meta.json#")
+	invalid, err := invalidSchemas(context.Background(), &fetcher{got: got.New()}, map[string]string{
+		"task.json#":   `{"$schema": "` + meta + `", "type": "object"}`,
+		"status.json#": `{"$schema": "` + meta + `", "type": "strnig"}`,
+		"run.json#":    `{"type": "strnig"}`,
+	}, false)
+	assert.NoError(err)
+	assert.Len(invalid, 1, "only schemas declaring a meta-schema are validated")
+	assert.Contains(invalid[0], "status.json#: ")
+	assert.Equal(1, c.Hits("/schemas/meta.json"), "each meta-schema is fetched once")
+
+	_, err = invalidSchemas(context.Background(), &fetcher{got: got.New()}, map[string]string{
+		"task.json#": `{"$schema": "` + c.SchemaURL("missing.json#") + `"}`,
+	}, false)
+	assert.Error(err)
+	assert.Contains(err.Error(), "failed to fetch meta-schema")
+
+	_, err = invalidSchemas(context.Background(), &fetcher{got: got.New()}, map[string]string{
+		"task.json#": `{"$schema": "` + meta + `", "type": "object"}`,
+	}, true)
+	assert.Error(err)
+	assert.Contains(err.Error(), "meta-schema of task.json# not served over https: "+meta)
+	assert.Equal(1, c.Hits("/schemas/meta.json"), "insecure meta-schemas are not fetched")
+}
+
+func TestCompressSchemas(t *testing.T) {
+	assert := assert.New(t)
+
+	properties := []string{}
+	for i := 0; i < 50; i++ {
+		properties = append(properties, fmt.Sprintf(`"field%d": {"type": "string", "description": "A field of the task"}`, i))
+	}
+	schemas := map[string]string{
+		"task.json#":   `{"type": "object", "properties": {` + strings.Join(properties, ", ") + `}}`,
+		"status.json#": `{"type": "object"}`,
+	}
+
+	compressed, err := compressSchemas(schemas)
+	assert.NoError(err)
+	again, err := compressSchemas(schemas)
+	assert.NoError(err)
+	assert.Equal(compressed, again, "compression is deterministic")
+
+	raw, packed := 0, 0
+	for url, s := range schemas {
+		r, err := gzip.NewReader(bytes.NewReader(compressed[url]))
+		assert.NoError(err)
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(s, string(data), "schemas round-trip byte for byte")
+		raw += len(s)
+		packed += len(compressed[url])
+	}
+	t.Logf("schemas: %d bytes, gzipped: %d bytes", raw, packed)
+	assert.True(packed*5 < raw, "verbose schemas shrink at least five-fold")
+
+	gen := &generator{}
+	gen.Print("package apis\n")
+	gen.PrintCompressedSchemas(compressed)
+	_, err = gen.Format()
+	assert.NoError(err, gen.String())
+}
+
+func TestDedupByContent(t *testing.T) {
+	assert := assert.New(t)
+
+	bodies, keys := dedupByContent(map[string]string{
+		"task.json#":    `{"type": "object"}`,
+		"task-v2.json#": `{"type": "object"}`,
+		"status.json#":  `{"type": "string"}`,
+	})
+	assert.Len(bodies, 2)
+	assert.Len(keys, 3)
+	assert.Equal(keys["task.json#"], keys["task-v2.json#"], "identical bodies share storage")
+	assert.NotEqual(keys["task.json#"], keys["status.json#"])
+	assert.Equal(`{"type": "object"}`, bodies[keys["task.json#"]])
+	assert.Len(keys["status.json#"], 64)
+}
+
+func TestFetchSchemaShape(t *testing.T) {
+	assert := assert.New(t)
+
+	c := testutil.NewFakeCluster(testutil.Config{
+		Schemas: map[string]string{
+			"task.json":  `{"$schema": "http://json-schema.org/draft-04/schema#", "type": "object"}`,
+			"empty.json": `{}`,
+			"true.json":  `true`,
+			"title.json": `{"title": "Task", "description": "A task", "required": ["taskId"]}`,
+			"list.json":  `["type", "object"]`,
+			"name.json":  `"task"`,
+		},
+	})
+	defer c.Close()
+
+	f := &fetcher{got: got.New()}
+	for _, name := range []string{"task.json", "empty.json", "true.json", "title.json"} {
+		_, err := fetchSchema(context.Background(), f, c.SchemaURL(name+"#"))
+		assert.NoError(err, name)
+	}
+
+	_, err := fetchSchema(context.Background(), f, c.SchemaURL("list.json#"))
+	assert.Error(err, "a schema must be an object or a boolean")
+	assert.Contains(err.Error(), c.SchemaURL("list.json#")+" is not a JSON schema")
+
+	_, err = fetchSchema(context.Background(), f, c.SchemaURL("name.json#"))
+	assert.Error(err)
+}
+
+func TestGenerateServicesDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	hang := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer s.Close()
+	defer close(hang)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := generateServices(ctx, &fetcher{got: got.New()}, s.URL+"/references/manifest.json", options{})
+	assert.Error(err)
+	assert.Contains(err.Error(), context.DeadlineExceeded.Error())
+	assert.True(time.Since(start) < time.Second, "a stalled server does not hold up generation")
+}
+
+func TestPrettyPrintNilMap(t *testing.T) {
+	assert := assert.New(t)
+
+	// An unnamed struct type, for the output to refer to no other package.
+	v := struct {
+		Nil   map[string]string
+		Empty map[string]string
+		Full  map[string]string
+	}{Empty: map[string]string{}, Full: map[string]string{"a": "b"}}
+
+	gen := &generator{}
+	gen.Print("package p\n")
+	gen.Print("var v = ")
+	gen.PrettyPrint(v)
+	gen.Print("\n")
+	code, err := gen.Format()
+	assert.NoError(err, gen.String())
+
+	// The output must also type-check, not only parse.
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "p.go", code, 0)
+	assert.NoError(err)
+	_, err = (&types.Config{}).Check("p", fset, []*ast.File{file}, nil)
+	assert.NoError(err)
+
+	assert.Contains(string(code), "Nil:   map[string]string(nil),")
+	assert.Contains(string(code), "Empty: map[string]string{},")
+	assert.Contains(string(code), "\"a\": \"b\",")
+}
+
+func TestPrettyPrintPointers(t *testing.T) {
+	assert := assert.New(t)
+
+	name, uptime := "queue", int64(42)
+	var routes []string
+	// Unnamed types, for the output to refer to no other package.
+	v := struct {
+		Inner   *struct{ Name string }
+		Missing *struct{ Name string }
+		Name    *string
+		Uptime  *int64
+		Routes  *[]string
+		Scopes  *[]string
+		Extra   interface{}
+		Title   interface{}
+	}{
+		Inner:  &struct{ Name string }{Name: "inner"},
+		Name:   &name,
+		Uptime: &uptime,
+		Routes: &routes,
+		Scopes: &[]string{"queue:*"},
+		Title:  "Queue API",
+	}
+
+	gen := &generator{}
+	gen.Print("package p\n")
+	gen.Print("var v = ")
+	gen.PrettyPrint(v)
+	gen.Print("\n")
+	code, err := gen.Format()
+	assert.NoError(err, gen.String())
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "p.go", code, 0)
+	assert.NoError(err)
+	_, err = (&types.Config{}).Check("p", fset, []*ast.File{file}, nil)
+	assert.NoError(err, string(code))
+
+	assert.Contains(string(code), "Inner: &struct{ Name string }{")
+	assert.Contains(string(code), "Missing: (*struct{ Name string })(nil),")
+	assert.Contains(string(code), "var v int64 = 42")
+	assert.Contains(string(code), "var v []string = []string(nil)")
+	assert.Contains(string(code), "Scopes: &[]string{")
+	assert.Contains(string(code), "Extra: nil,")
+	assert.Contains(string(code), `Title: "Queue API",`)
+	assert.NotContains(string(code), "0x", "no pointer addresses are embedded")
+}
+
+func TestGenerateServicesToFile(t *testing.T) {
+	assert := assert.New(t)
+
+	c := testutil.NewFakeCluster(testutil.Config{
+		Services: []testutil.Service{
+			testutil.Service{Name: "Queue", Title: "Queue API"},
+		},
+	})
+	defer c.Close()
+
+	dir, err := ioutil.TempDir("", "fetch-apis")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "apis", "services.go")
+	f := &fetcher{got: got.New()}
+	assert.NoError(generateServicesToFile(context.Background(), f, c.ManifestURL(), out, options{}))
+	data, err := ioutil.ReadFile(out)
+	assert.NoError(err)
+	assert.Contains(string(data), `"Queue": definitions.Service{`)
+
+	// A failed generation leaves the previous file in place.
+	err = generateServicesToFile(context.Background(), f, c.URL+"/references/missing.json", out, options{})
+	assert.Error(err)
+	again, err := ioutil.ReadFile(out)
+	assert.NoError(err)
+	assert.Equal(data, again)
+
+	files, err := ioutil.ReadDir(filepath.Dir(out))
+	assert.NoError(err)
+	assert.Len(files, 1, "no temporary files are left behind")
+}
+
+func TestFormatError(t *testing.T) {
+	assert := assert.New(t)
+
+	gen := &generator{}
+	gen.Print("package apis\n\n")
+	gen.Print("var services = map[string]string{\n")
+	gen.Print("\"Queue\": \"queue\",\n")
+	gen.Print("\"Index\" \"index\",\n")
+	gen.Print("}\n")
+
+	_, err := gen.Format()
+	assert.Error(err)
+	assert.Contains(err.Error(), "5:")
+	assert.Contains(err.Error(), "     4 | \"Queue\": \"queue\",\n")
+	assert.Contains(err.Error(), ">    5 | \"Index\" \"index\",\n")
+	assert.Contains(err.Error(), "     6 | }\n")
+}
+
+// importerFunc implements types.Importer with a function.
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) {
+	return f(path)
+}
+
+// checkServices type-checks the generated services.go along with
+// apis/schemas.go, which reads the variables it defines, and the definitions
+// package it imports.
+func checkServices(t *testing.T, code []byte) {
+	assert := assert.New(t)
+
+	fset := token.NewFileSet()
+	parse := func(paths ...string) []*ast.File {
+		var files []*ast.File
+		for _, p := range paths {
+			f, err := parser.ParseFile(fset, p, nil, 0)
+			assert.NoError(err)
+			files = append(files, f)
+		}
+		return files
+	}
+
+	std := importer.Default()
+	paths, err := filepath.Glob(filepath.Join("..", "definitions", "*.go"))
+	assert.NoError(err)
+	var sources []string
+	for _, p := range paths {
+		if !strings.HasSuffix(p, "_test.go") {
+			sources = append(sources, p)
+		}
+	}
+	const definitionsPath = "github.com/taskcluster/taskcluster-cli/apis/definitions"
+	defs, err := (&types.Config{Importer: std}).Check(definitionsPath, fset, parse(sources...), nil)
+	assert.NoError(err)
+
+	services, err := parser.ParseFile(fset, "services.go", code, 0)
+	assert.NoError(err)
+	conf := &types.Config{Importer: importerFunc(func(path string) (*types.Package, error) {
+		if path == definitionsPath {
+			return defs, nil
+		}
+		return std.Import(path)
+	})}
+	files := append(parse(filepath.Join("..", "schemas.go")), services)
+	_, err = conf.Check("github.com/taskcluster/taskcluster-cli/apis", fset, files, nil)
+	assert.NoError(err, string(code))
+}
+
+func TestGenerateServicesOptions(t *testing.T) {
+	c := testutil.NewFakeCluster(testutil.Config{
+		Services: []testutil.Service{
+			testutil.Service{
+				Name: "Queue",
+				Entries: []definitions.Entry{
+					definitions.Entry{
+						Name:   "createTask",
+						Input:  "/schemas/queue/v1/task.json#",
+						Output: "/schemas/queue/v1/status.json#",
+					},
+					definitions.Entry{Name: "status", Output: "/schemas/queue/v1/status-v2.json#"},
+				},
+			},
+		},
+		Schemas: map[string]string{
+			"meta.json":               `{"type": "object", "properties": {"type": {"enum": ["object", "string"]}}}`,
+			"queue/v1/task.json":      `{"type": "object", "properties": {"status": {"$ref": "status.json#"}}}`,
+			"queue/v1/status.json":    `{"type": "object", "properties": {"state": {"type": "string"}}}`,
+			"queue/v1/status-v2.json": `{"type": "object", "properties": {"state": {"type": "string"}}}`,
+		},
+	})
+	defer c.Close()
+
+	generate := func(opts options) (string, error) {
+		code, err := generateServices(context.Background(), &fetcher{got: got.New()}, c.ManifestURL(), opts)
+		if err == nil {
+			checkServices(t, code)
+		}
+		return string(code), err
+	}
+	assert := assert.New(t)
+
+	code, err := generate(options{})
+	assert.NoError(err)
+	assert.Contains(code, "var schemas = map[string]string{")
+	assert.Contains(code, `\"$ref\"`)
+	assert.Equal(2, strings.Count(code, `\"state\"`))
+
+	code, err = generate(options{ResolveRefs: true})
+	assert.NoError(err)
+	assert.NotContains(code, `$ref`)
+
+	code, err = generate(options{TypedSchemas: true})
+	assert.NoError(err)
+	assert.Contains(code, "type QueueCreateTaskRequest struct {")
+	assert.Contains(code, "type QueueCreateTaskResponse struct {")
+
+	code, err = generate(options{GzipSchemas: true})
+	assert.NoError(err)
+	assert.Contains(code, "compressedSchemas = map[string][]byte{")
+	assert.Contains(code, "var schemas map[string]string")
+
+	code, err = generate(options{DedupSchemas: true})
+	assert.NoError(err)
+	assert.Contains(code, "schemaKeys = map[string]string{")
+	assert.Equal(1, strings.Count(code, `\"state\"`), "status.json and status-v2.json share a body")
+
+	code, err = generate(options{DedupSchemas: true, GzipSchemas: true, TypedSchemas: true, ResolveRefs: true})
+	assert.NoError(err)
+	assert.Contains(code, "schemaKeys = map[string]string{")
+	assert.Contains(code, "compressedSchemas = map[string][]byte{")
+
+	hits := c.Hits("/references/manifest.json")
+	_, err = generate(options{RequireHTTPS: true})
+	assert.Error(err)
+	assert.Contains(err.Error(), "api manifest not served over https: "+c.ManifestURL())
+	assert.Equal(hits, c.Hits("/references/manifest.json"), "an insecure manifest is not fetched")
+}
+
+func TestGenerateServicesSchemaValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	schemas := map[string]string{
+		"meta.json": `{"type": "object", "properties": {"type": {"enum": ["object", "string"]}}}`,
+	}
+	c := testutil.NewFakeCluster(testutil.Config{
+		Services: []testutil.Service{
+			testutil.Service{
+				Name:    "Queue",
+				Entries: []definitions.Entry{definitions.Entry{Name: "task", Output: "/schemas/queue/v1/task.json#"}},
+			},
+		},
+		Schemas: schemas,
+	})
+	defer c.Close()
+	// The schema refers to the meta-schema by absolute URL, only known once
+	// the cluster is started.
+	schemas["queue/v1/task.json"] = `{"$schema": "` + c.SchemaURL("meta.json#") + `", "type": "strnig"}`
+
+	f := &fetcher{got: got.New()}
+	_, err := generateServices(context.Background(), f, c.ManifestURL(), options{SchemaValidation: "error"})
+	assert.Error(err)
+	assert.Contains(err.Error(), "schemas not valid against their meta-schema")
+
+	code, err := generateServices(context.Background(), f, c.ManifestURL(), options{SchemaValidation: "warn"})
+	assert.NoError(err)
+	checkServices(t, code)
+
+	_, err = generateServices(context.Background(), f, c.ManifestURL(), options{})
+	assert.NoError(err, "schemas are not validated by default")
+}
+
+func TestInstallCacheUnwritable(t *testing.T) {
+	assert := assert.New(t)
+
+	c := testutil.NewFakeCluster(testutil.Config{
+		Services: []testutil.Service{
+			testutil.Service{Name: "Queue", Title: "Queue API"},
+		},
+	})
+	defer c.Close()
+
+	// A directory cannot be created below a regular file, whatever the
+	// permissions of the user running the test.
+	file, err := ioutil.TempFile("", "fetch-apis-cache")
+	assert.NoError(err)
+	defer os.Remove(file.Name())
+	assert.NoError(file.Close())
+
+	client, err := newClient(time.Minute, "", true)
+	assert.NoError(err)
+	installCache(client, filepath.Join(file.Name(), "cache"), true)
+	_, cached := client.Transport.(*cachingTransport)
+	assert.False(cached, "caching is disabled when the cache directory cannot be created")
+
+	g := got.New()
+	g.Client = client
+	code, err := generateServices(context.Background(), &fetcher{got: g}, c.ManifestURL(), options{})
+	assert.NoError(err)
+	assert.Contains(string(code), `"Queue": definitions.Service{`)
+
+	dir, err := ioutil.TempDir("", "fetch-apis-cache")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	installCache(client, filepath.Join(dir, "cache"), true)
+	_, cached = client.Transport.(*cachingTransport)
+	assert.True(cached)
+}
@@ -0,0 +1,76 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	got "github.com/taskcluster/go-got"
+)
+
+func TestWriteFileAtomicUmask(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fetch-apis")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	defer syscall.Umask(syscall.Umask(077))
+
+	p := filepath.Join(dir, "services.go")
+	assert.NoError(writeFileAtomic(p, []byte("package apis\n"), 0664))
+	info, err := os.Stat(p)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm(), "the umask applies")
+
+	syscall.Umask(022)
+	assert.NoError(writeFileAtomic(p, []byte("package apis\n"), 0664))
+	info, err = os.Stat(p)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0644), info.Mode().Perm())
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(err)
+	assert.Len(files, 1, "no temporary files are left behind")
+}
+
+func TestInstallCachePermissions(t *testing.T) {
+	assert := assert.New(t)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("{}"))
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "fetch-apis")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	defer syscall.Umask(syscall.Umask(022))
+
+	cache := filepath.Join(dir, "cache")
+	c := &http.Client{}
+	installCache(c, cache, true)
+	g := got.New()
+	g.Client = c
+	_, err = (&fetcher{got: g}).Get(context.Background(), s.URL)
+	assert.NoError(err)
+
+	info, err := os.Stat(cache)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0700), info.Mode().Perm(), "the cache directory is private")
+	files, err := ioutil.ReadDir(cache)
+	assert.NoError(err)
+	assert.Len(files, 1)
+	assert.Equal(os.FileMode(0600), files[0].Mode().Perm(), "cached responses are private")
+}
@@ -0,0 +1,103 @@
+package apis
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"github.com/taskcluster/taskcluster-cli/apis/definitions"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "graph",
+		Short: "Print the known services as a Graphviz DOT graph.",
+		Long: `Print the known services as a Graphviz DOT graph.
+
+Services are grouped by the host serving them. With --endpoints, each API
+endpoint is added as a node linked to its service. The result can be
+rendered with Graphviz, e.g. 'taskcluster api graph | dot -Tsvg > api.svg'.`,
+		RunE: runGraph,
+	}
+	cmd.Flags().Bool("endpoints", false, "Include a node for each API endpoint")
+
+	Command.AddCommand(cmd)
+}
+
+func runGraph(cmd *cobra.Command, args []string) error {
+	// --dry-run is inherited from the api command, but there is no request
+	// to validate here.
+	if dry, _ := cmd.Flags().GetBool("dry-run"); dry {
+		return errors.New("The --dry-run flag is not supported by graph")
+	}
+
+	output, closeOutput, err := openOutput(cmd)
+	if err != nil {
+		return err
+	}
+	defer closeOutput()
+
+	endpoints, _ := cmd.Flags().GetBool("endpoints")
+	return writeGraph(output, services, endpoints)
+}
+
+// writeGraph writes services to w as a DOT graph, with one cluster per host.
+// Services and endpoints are sorted so the output is stable.
+func writeGraph(w io.Writer, services map[string]definitions.Service, endpoints bool) error {
+	hosts := make(map[string][]string)
+	for name, service := range services {
+		host := service.BaseURL
+		if u, err := url.Parse(service.BaseURL); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		hosts[host] = append(hosts[host], name)
+	}
+
+	hostnames := make([]string, 0, len(hosts))
+	for host := range hosts {
+		hostnames = append(hostnames, host)
+	}
+	sort.Strings(hostnames)
+
+	// Only the first write error is interesting, the rest will fail the
+	// same way.
+	var err error
+	printf := func(format string, a ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, a...)
+		}
+	}
+
+	printf("digraph taskcluster {\n")
+	printf("  node [shape=box];\n")
+	for i, host := range hostnames {
+		names := hosts[host]
+		sort.Strings(names)
+
+		printf("  subgraph cluster_%d {\n", i)
+		printf("    label=%q;\n", host)
+		for _, name := range names {
+			printf("    %q [label=%q];\n", name, name+"\n"+services[name].Title)
+		}
+		printf("  }\n")
+	}
+
+	if endpoints {
+		for _, host := range hostnames {
+			for _, name := range hosts[host] {
+				for _, entry := range services[name].Entries {
+					id := name + "." + entry.Name
+					printf("  %q [label=%q, shape=ellipse];\n", id, entry.Name)
+					printf("  %q -> %q;\n", name, id)
+				}
+			}
+		}
+	}
+	printf("}\n")
+
+	return err
+}
@@ -0,0 +1,82 @@
+package apis
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/taskcluster/taskcluster-cli/apis/definitions"
+)
+
+func TestWriteGraph(t *testing.T) {
+	assert := assert.New(t)
+
+	services := map[string]definitions.Service{
+		"Queue": definitions.Service{
+			BaseURL: "https://queue.taskcluster.net/v1",
+			Title:   "Queue API",
+			Entries: []definitions.Entry{
+				definitions.Entry{Name: "ping"},
+			},
+		},
+		"Index": definitions.Service{
+			BaseURL: "https://index.taskcluster.net/v1",
+			Title:   "Task Index",
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	assert.NoError(writeGraph(buf, services, false))
+	assert.Equal(`digraph taskcluster {
+  node [shape=box];
+  subgraph cluster_0 {
+    label="index.taskcluster.net";
+    "Index" [label="Index\nTask Index"];
+  }
+  subgraph cluster_1 {
+    label="queue.taskcluster.net";
+    "Queue" [label="Queue\nQueue API"];
+  }
+}
+`, buf.String())
+
+	buf.Reset()
+	assert.NoError(writeGraph(buf, services, true))
+	assert.Contains(buf.String(), `"Queue.ping" [label="ping", shape=ellipse];`)
+	assert.Contains(buf.String(), `"Queue" -> "Queue.ping";`)
+}
+
+func TestRunGraph(t *testing.T) {
+	assert := assert.New(t)
+
+	newCmd := func() *cobra.Command {
+		cmd := &cobra.Command{Use: "graph"}
+		cmd.Flags().Bool("endpoints", false, "")
+		cmd.Flags().String("output", "-", "")
+		cmd.Flags().Bool("dry-run", false, "")
+		return cmd
+	}
+
+	dir, err := ioutil.TempDir("", "graph")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	cmd := newCmd()
+	output := filepath.Join(dir, "api.dot")
+	assert.NoError(cmd.Flags().Set("output", output))
+	assert.NoError(runGraph(cmd, nil))
+	data, err := ioutil.ReadFile(output)
+	assert.NoError(err)
+	assert.Contains(string(data), "digraph taskcluster {")
+
+	cmd = newCmd()
+	assert.NoError(cmd.Flags().Set("dry-run", "true"))
+	err = runGraph(cmd, nil)
+	assert.Error(err)
+	assert.Contains(err.Error(), "--dry-run")
+}
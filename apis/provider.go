@@ -84,6 +84,21 @@ func init() {
 	root.Command.AddCommand(Command)
 }
 
+// openOutput returns the writer cmd should write its output to: the file
+// given with --output, or the standard output of cmd. The returned function
+// closes the file, if any, once the caller is done.
+func openOutput(cmd *cobra.Command) (io.Writer, func(), error) {
+	if flag := cmd.Flags().Lookup("output"); flag != nil && flag.Changed {
+		filename := flag.Value.String()
+		f, err := os.Create(filename)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to open output file, error: %s", err)
+		}
+		return f, func() { f.Close() }, nil
+	}
+	return cmd.OutOrStdout(), func() {}, nil
+}
+
 func buildHelp(entry *definitions.Entry) string {
 	buf := &bytes.Buffer{}
 
@@ -140,16 +155,11 @@ func buildExecutor(entry definitions.Entry, configKey string) func(*cobra.Comman
 		}
 
 		// Setup output
-		var output = cmd.OutOrStdout()
-		if flag := cmd.Flags().Lookup("output"); flag != nil && flag.Changed {
-			filename := flag.Value.String()
-			f, err := os.Create(filename)
-			if err != nil {
-				return fmt.Errorf("Failed to open output file, error: %s", err)
-			}
-			defer f.Close()
-			output = f
+		output, closeOutput, err := openOutput(cmd)
+		if err != nil {
+			return err
 		}
+		defer closeOutput()
 
 		if dry, _ := cmd.Flags().GetBool("dry-run"); dry {
 			return validate(&entry, argmap, query, input, output)
@@ -169,7 +179,7 @@ func validate(
 	payload io.Reader, output io.Writer,
 ) error {
 	// If there is no schema, there is nothing to validate
-	schema, ok := schemas[entry.Input]
+	schema, ok := loadSchema(entry.Input)
 	if !ok {
 		return nil
 	}
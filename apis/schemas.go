@@ -0,0 +1,68 @@
+package apis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// compressedSchemas holds the gzipped schemas when services.go is generated
+// with -gzip-schemas. The schemas map is then only filled on first use, by
+// loadSchema.
+var compressedSchemas map[string][]byte
+
+// schemaKeys maps each schema URL to the SHA-256 of its body when services.go
+// is generated with -dedup-schemas. The schemas are then keyed by SHA-256,
+// each body being stored once, until loadSchema keys them by URL.
+var schemaKeys map[string]string
+
+var decompressOnce sync.Once
+
+// loadSchema returns the schema with the given URL, if any.
+func loadSchema(url string) (string, bool) {
+	decompressOnce.Do(func() {
+		if compressedSchemas != nil {
+			s, err := decompressSchemas(compressedSchemas)
+			if err != nil {
+				panic(fmt.Sprintf("corrupt generated schemas: %s", err))
+			}
+			schemas = s
+		}
+		if schemaKeys != nil {
+			schemas = expandSchemas(schemaKeys, schemas)
+		}
+	})
+	s, ok := schemas[url]
+	return s, ok
+}
+
+// decompressSchemas returns the given gzipped schemas, decompressed.
+func decompressSchemas(compressed map[string][]byte) (map[string]string, error) {
+	schemas := make(map[string]string, len(compressed))
+	for url, data := range compressed {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", url, err)
+		}
+		s, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", url, err)
+		}
+		schemas[url] = string(s)
+	}
+	return schemas, nil
+}
+
+// expandSchemas returns the schema bodies, keyed by SHA-256, keyed by URL
+// instead. URLs with the same body share its storage.
+func expandSchemas(keys, bodies map[string]string) map[string]string {
+	schemas := make(map[string]string, len(keys))
+	for url, key := range keys {
+		if body, ok := bodies[key]; ok {
+			schemas[url] = body
+		}
+	}
+	return schemas
+}
@@ -0,0 +1,45 @@
+package apis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestDecompressSchemas(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	_, err := w.Write([]byte(`{"type": "object"}`))
+	assert.NoError(err)
+	assert.NoError(w.Close())
+
+	s, err := decompressSchemas(map[string][]byte{"task.json#": buf.Bytes()})
+	assert.NoError(err)
+	assert.Equal(map[string]string{"task.json#": `{"type": "object"}`}, s)
+
+	_, err = decompressSchemas(map[string][]byte{"task.json#": []byte(`{}`)})
+	assert.Error(err)
+}
+
+func TestExpandSchemas(t *testing.T) {
+	assert := assert.New(t)
+
+	s := expandSchemas(map[string]string{
+		"task.json#":    "a1",
+		"task-v2.json#": "a1",
+		"status.json#":  "b2",
+		"missing.json#": "c3",
+	}, map[string]string{
+		"a1": `{"type": "object"}`,
+		"b2": `{"type": "string"}`,
+	})
+	assert.Equal(map[string]string{
+		"task.json#":    `{"type": "object"}`,
+		"task-v2.json#": `{"type": "object"}`,
+		"status.json#":  `{"type": "string"}`,
+	}, s)
+}
@@ -5,7 +5,9 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/spf13/pflag"
 	tcclient "github.com/taskcluster/taskcluster-client-go"
@@ -115,12 +117,28 @@ func runArtifacts(credentials *tcclient.Credentials, args []string, out io.Write
 	return nil
 }
 
+// logClient fetches live logs. The log is streamed for as long as the task
+// runs, so rather than bounding the whole request it only gives up on
+// connecting and on waiting for the response to start.
+var logClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// runLog streams the live log of a given task.
 func runLog(credentials *tcclient.Credentials, args []string, out io.Writer, flagSet *pflag.FlagSet) error {
 	taskID := args[0]
 
 	path := "https://queue.taskcluster.net/v1/task/" + taskID + "/artifacts/public/logs/live.log"
 
-	resp, err := http.Get(path)
+	resp, err := logClient.Get(path)
 	if err != nil {
 		return fmt.Errorf("Error making request to %v: %v", path, err)
 	}
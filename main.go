@@ -13,8 +13,6 @@ func main() {
 
 	// gentlemen, START YOUR ENGINES
 	if err := root.Command.Execute(); err != nil {
-		os.Exit(0)
-	} else {
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,174 @@
+// Package testutil provides helpers for testing code that talks to
+// TaskCluster, without reaching the real deployment.
+package testutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/taskcluster/taskcluster-cli/apis/definitions"
+)
+
+// Service describes a service served by a FakeCluster.
+type Service struct {
+	Name  string // Name of the service in the manifest, e.g. "Queue"
+	Title string // Title of the service reference
+
+	// Entries of the reference, besides ping. Input and output schemas
+	// starting with a slash are relative to the server, e.g.
+	// "/schemas/queue/v1/task.json#".
+	Entries []definitions.Entry
+
+	Alive      bool          // Value of alive in ping responses
+	Uptime     float64       // Value of uptime in ping responses
+	Latency    time.Duration // Delay before answering pings
+	StatusCode int           // Status code of ping responses, 200 if unset
+}
+
+// Config describes what a FakeCluster serves.
+type Config struct {
+	Services []Service
+	Schemas  map[string]string // Schema bodies, by path relative to /schemas/
+}
+
+// FakeCluster is an HTTP server mimicking a TaskCluster deployment. It serves
+// a manifest listing the configured services, a reference for each of them
+// with a ping entry, the ping endpoints themselves and the given schemas:
+//
+//	/references/manifest.json
+//	/references/<name>/v1/api.json
+//	/<name>/v1/ping
+//	/schemas/<path>
+//
+// where <name> is the lower-cased service name.
+type FakeCluster struct {
+	*httptest.Server
+
+	config Config
+	mutex  sync.Mutex
+	hits   map[string]int
+}
+
+// NewFakeCluster starts a FakeCluster serving config. It must be closed by the
+// caller once done.
+func NewFakeCluster(config Config) *FakeCluster {
+	c := &FakeCluster{
+		config: config,
+		hits:   make(map[string]int),
+	}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.serve))
+	return c
+}
+
+// ManifestURL returns the URL of the manifest.
+func (c *FakeCluster) ManifestURL() string {
+	return c.URL + "/references/manifest.json"
+}
+
+// ReferenceURL returns the URL of the reference of the named service.
+func (c *FakeCluster) ReferenceURL(name string) string {
+	return c.URL + "/references/" + strings.ToLower(name) + "/v1/api.json"
+}
+
+// BaseURL returns the base URL of the named service.
+func (c *FakeCluster) BaseURL(name string) string {
+	return c.URL + "/" + strings.ToLower(name) + "/v1"
+}
+
+// SchemaURL returns the URL at which the schema with the given path is
+// served.
+func (c *FakeCluster) SchemaURL(path string) string {
+	return c.URL + "/schemas/" + path
+}
+
+// Hits returns the number of requests made so far for path.
+func (c *FakeCluster) Hits(path string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hits[path]
+}
+
+func (c *FakeCluster) serve(w http.ResponseWriter, r *http.Request) {
+	c.mutex.Lock()
+	c.hits[r.URL.Path]++
+	c.mutex.Unlock()
+
+	if r.URL.Path == "/references/manifest.json" {
+		manifest := make(map[string]string)
+		for _, s := range c.config.Services {
+			manifest[s.Name] = c.ReferenceURL(s.Name)
+		}
+		writeJSON(w, http.StatusOK, manifest)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/schemas/") {
+		schema, ok := c.config.Schemas[strings.TrimPrefix(r.URL.Path, "/schemas/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(schema))
+		return
+	}
+
+	for _, s := range c.config.Services {
+		switch r.URL.Path {
+		case "/references/" + strings.ToLower(s.Name) + "/v1/api.json":
+			entries := []definitions.Entry{
+				definitions.Entry{
+					Type:   "function",
+					Name:   "ping",
+					Title:  "Ping Server",
+					Method: "get",
+					Route:  "/ping",
+					Args:   []string{},
+				},
+			}
+			for _, e := range s.Entries {
+				if strings.HasPrefix(e.Input, "/") {
+					e.Input = c.URL + e.Input
+				}
+				if strings.HasPrefix(e.Output, "/") {
+					e.Output = c.URL + e.Output
+				}
+				entries = append(entries, e)
+			}
+			writeJSON(w, http.StatusOK, definitions.Service{
+				BaseURL: c.BaseURL(s.Name),
+				Title:   s.Title,
+				Entries: entries,
+			})
+			return
+		case "/" + strings.ToLower(s.Name) + "/v1/ping":
+			time.Sleep(s.Latency)
+			status := s.StatusCode
+			if status == 0 {
+				status = http.StatusOK
+			}
+			writeJSON(w, status, map[string]interface{}{
+				"alive":  s.Alive,
+				"uptime": s.Uptime,
+			})
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
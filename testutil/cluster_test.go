@@ -0,0 +1,68 @@
+package testutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/taskcluster/taskcluster-cli/apis/definitions"
+)
+
+func getJSON(t *testing.T, url string, v interface{}) int {
+	assert := assert.New(t)
+
+	res, err := http.Get(url)
+	assert.NoError(err)
+	defer res.Body.Close()
+	assert.NoError(json.NewDecoder(res.Body).Decode(v))
+	return res.StatusCode
+}
+
+func TestFakeCluster(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewFakeCluster(Config{
+		Services: []Service{
+			Service{Name: "Queue", Title: "Queue API", Alive: true, Uptime: 42},
+			Service{Name: "Index", Alive: false, StatusCode: 503, Latency: 10 * time.Millisecond},
+		},
+		Schemas: map[string]string{
+			"queue/v1/task.json": `{"type": "object"}`,
+		},
+	})
+	defer c.Close()
+
+	var manifest map[string]string
+	assert.Equal(200, getJSON(t, c.ManifestURL(), &manifest))
+	assert.Equal(map[string]string{
+		"Queue": c.ReferenceURL("Queue"),
+		"Index": c.ReferenceURL("Index"),
+	}, manifest)
+
+	var reference definitions.Service
+	assert.Equal(200, getJSON(t, manifest["Queue"], &reference))
+	assert.Equal("Queue API", reference.Title)
+	assert.Equal(c.BaseURL("Queue"), reference.BaseURL)
+	assert.Equal("ping", reference.Entries[0].Name)
+
+	var ping struct {
+		Alive  bool    `json:"alive"`
+		Uptime float64 `json:"uptime"`
+	}
+	assert.Equal(200, getJSON(t, c.BaseURL("Queue")+"/ping", &ping))
+	assert.True(ping.Alive)
+	assert.Equal(42.0, ping.Uptime)
+
+	start := time.Now()
+	assert.Equal(503, getJSON(t, c.BaseURL("Index")+"/ping", &ping))
+	assert.False(ping.Alive)
+	assert.True(time.Since(start) >= 10*time.Millisecond)
+	assert.Equal(1, c.Hits("/index/v1/ping"))
+
+	var schema map[string]string
+	assert.Equal(200, getJSON(t, c.SchemaURL("queue/v1/task.json"), &schema))
+	assert.Equal("object", schema["type"])
+}